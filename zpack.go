@@ -2,16 +2,22 @@ package zpack
 
 import (
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
 	"compress/zlib"
+	"crypto/sha256"
 	"encoding/base64"
 	"fmt"
+	"go/format"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
+	"time"
 	"unicode"
 	"unicode/utf8"
 )
@@ -38,17 +44,138 @@ import (
 //     }
 //
 // The ignore patterns are matched by strings.HasSuffix().
+//
+// Pack writes no "_dev.go" mirror and no build constraint; use PackOpts
+// with Options.Dev for a //go:build dev mirror that reads the same
+// variables from their original on-disk paths.
+//
+// Pack uses the default codec policy and reads from the current working
+// directory (or absolute paths); use PackOpts to read from an fs.FS or to
+// choose codecs.
 func Pack(data map[string]map[string]string, ignore ...string) error {
+	return PackOpts(data, Options{Ignore: ignore})
+}
+
+// PackOpts is like Pack, but lets the caller read from opts.FS and control
+// codec selection via opts. opts.Ignore takes the place of Pack's variadic
+// ignore patterns.
+//
+// The "_dev.go" mirror is written only when opts.Dev is true; it only makes
+// sense for a real on-disk filesystem, so it's also skipped when opts.FS is
+// set even if opts.Dev is true.
+func PackOpts(data map[string]map[string]string, opts Options) error {
+	useDev := opts.Dev && opts.FS == nil
+
 	for out, content := range data {
-		// TODO: be atomic; that is, we don't want to clobber anything existing
-		// unless we're sure we'll be creating valid Go files.
-		fp, err := os.Create(out)
+		devOut := strings.TrimSuffix(out, ".go") + "_dev.go"
+
+		opts.used = map[string]Codec{}
+
+		var body, devBody bytes.Buffer
+
+		var varnames []string
+		for v := range content {
+			varnames = append(varnames, v)
+		}
+		sort.Strings(varnames)
+
+		for _, varname := range varnames {
+			files := content[varname]
+			fsys, name := opts.fsys(files)
+			st, err := fs.Stat(fsys, name)
+			if err != nil {
+				return err
+			}
+
+			if st.IsDir() {
+				err = DirOpts(&body, varname, files, opts)
+			} else {
+				err = FileOpts(&body, varname, files, opts)
+			}
+			if err != nil {
+				return err
+			}
+
+			if !useDev {
+				continue
+			}
+			abs, err := filepath.Abs(files)
+			if err != nil {
+				return err
+			}
+			if st.IsDir() {
+				err = devDir(&devBody, varname, abs, name)
+			} else {
+				err = devFile(&devBody, varname, abs)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		// The header is only known once the body has been generated, since
+		// the import block depends on which codecs the body ended up using.
+		pkg := filepath.Base(filepath.Dir(out))
+		var buf bytes.Buffer
+		var buildTags []string
+		if useDev {
+			buildTags = []string{"!dev"}
+		}
+		err := Header(&buf, pkg, opts.imports(), buildTags...)
+		if err != nil {
+			return err
+		}
+		_, err = buf.Write(body.Bytes())
 		if err != nil {
 			return err
 		}
-		defer func() { fp.Close() }()
 
-		err = Header(fp, filepath.Base(filepath.Dir(out)))
+		// writeFormatted only replaces out/devOut once formatting succeeds,
+		// so a malformed template above never clobbers an existing file.
+		err = writeFormatted(out, buf.Bytes())
+		if err != nil {
+			return err
+		}
+
+		if !useDev {
+			continue
+		}
+
+		var devBuf bytes.Buffer
+		err = HeaderDev(&devBuf, pkg)
+		if err != nil {
+			return err
+		}
+		_, err = devBuf.Write(devBody.Bytes())
+		if err != nil {
+			return err
+		}
+		err = writeFormatted(devOut, devBuf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PackEmbed is like Pack, but instead of encoding the file contents as
+// base64/zlib byte literals it emits //go:embed directives that bind each
+// variable, relying on Go 1.16+ to do the embedding at build time. This
+// avoids the decode-at-init overhead of Options.encode at the cost of
+// requiring a modern Go toolchain.
+//
+// Since //go:embed paths are resolved relative to the package directory,
+// referenced files and directories are first copied into a staging
+// directory next to the output file (named after the output file, with an
+// ".embed" suffix).
+func PackEmbed(data map[string]map[string]string, ignore ...string) error {
+	for out, content := range data {
+		stage := strings.TrimSuffix(out, filepath.Ext(out)) + ".embed"
+		err := os.RemoveAll(stage)
+		if err != nil {
+			return err
+		}
+		err = os.MkdirAll(stage, 0755)
 		if err != nil {
 			return err
 		}
@@ -59,28 +186,60 @@ func Pack(data map[string]map[string]string, ignore ...string) error {
 		}
 		sort.Strings(varnames)
 
+		// The header is only known once the body has been generated: it
+		// only needs to name "embed" as a type (embed.FS) when at least one
+		// entry is a directory, and must otherwise fall back to a blank
+		// import, since a //go:embed directive binding a []byte needs
+		// nothing but the directive's side effect.
+		var body bytes.Buffer
+		var hasDir bool
 		for _, varname := range varnames {
-			files := content[varname]
-			st, err := os.Stat(files)
+			src := content[varname]
+			st, err := os.Stat(src)
 			if err != nil {
 				return err
 			}
 
+			// Namespaced by varname, not just the source basename, so two
+			// entries whose sources share a basename in different
+			// directories (e.g. "srcA/data.txt" and "srcB/data.txt") don't
+			// collide in the staging dir.
+			dst := filepath.Join(stage, varname, filepath.Base(src))
+			rel := filepath.ToSlash(filepath.Join(filepath.Base(stage), varname, filepath.Base(src)))
 			if st.IsDir() {
-				err = Dir(fp, varname, files, ignore...)
+				hasDir = true
+				err = copyDir(src, dst, ignore...)
+				if err != nil {
+					return err
+				}
+				err = embedDir(&body, varname, rel)
 			} else {
-				err = File(fp, varname, files)
+				err = os.MkdirAll(filepath.Dir(dst), 0755)
+				if err != nil {
+					return err
+				}
+				err = copyFile(src, dst)
+				if err != nil {
+					return err
+				}
+				err = embedFile(&body, varname, rel)
 			}
 			if err != nil {
 				return err
 			}
 		}
 
-		err = fp.Close()
+		var buf bytes.Buffer
+		err = HeaderEmbed(&buf, filepath.Base(filepath.Dir(out)), hasDir)
+		if err != nil {
+			return err
+		}
+		_, err = buf.Write(body.Bytes())
 		if err != nil {
 			return err
 		}
-		err = Format(out)
+
+		err = writeFormatted(out, buf.Bytes())
 		if err != nil {
 			return err
 		}
@@ -88,86 +247,683 @@ func Pack(data map[string]map[string]string, ignore ...string) error {
 	return nil
 }
 
-// Header writes a file header, which is a code generation comment and package
-// declaration.
-func Header(fp io.Writer, pkg string) error {
+// HeaderEmbed writes a file header for output generated with PackEmbed; like
+// Header, but it imports "embed" instead of the zlib/base64 decode helpers.
+//
+// hasDir selects how "embed" is imported: a //go:embed directive binding an
+// embed.FS variable (for a directory) names the "embed" type directly, but
+// one binding only a []byte needs nothing but the directive's side effect,
+// so it must use a blank import or go build fails with "imported and not
+// used".
+func HeaderEmbed(fp io.Writer, pkg string, hasDir bool) error {
+	_, err := fp.Write([]byte("// Code generated by pack.go; DO NOT EDIT.\n\n"))
+	if err != nil {
+		return err
+	}
+	imp := `_ "embed"`
+	if hasDir {
+		imp = `"embed"`
+	}
+	_, err = fp.Write([]byte("package " + pkg + "\n\nimport (\n\t" + imp + "\n)\n\n"))
+	return err
+}
+
+// embedFile writes a //go:embed directive binding a single file to varname.
+func embedFile(fp io.Writer, varname, path string) error {
+	_, err := fmt.Fprintf(fp, "//go:embed %s\nvar %s []byte\n\n", path, varname)
+	return err
+}
+
+// embedDir writes a //go:embed directive binding a directory to varname as
+// an embed.FS. The "all:" prefix is used so files starting with "." or "_"
+// are included too, matching what Dir packs.
+func embedDir(fp io.Writer, varname, path string) error {
+	_, err := fmt.Fprintf(fp, "//go:embed all:%s\nvar %s embed.FS\n\n", path, varname)
+	return err
+}
+
+// copyFile copies a single file's contents, used to stage files for
+// PackEmbed.
+func copyFile(src, dst string) error {
+	d, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, d, 0644)
+}
+
+// copyDir recursively copies a directory, used to stage directories for
+// PackEmbed.
+//
+// The ignore patterns are matched by strings.HasSuffix().
+func copyDir(src, dst string, ignore ...string) error {
+	err := os.MkdirAll(dst, 0755)
+	if err != nil {
+		return err
+	}
+
+	if !strings.HasSuffix(src, "/") {
+		src += "/"
+	}
+
+	return filepath.Walk(src, func(path string, st os.FileInfo, err error) error {
+		if err != nil {
+			return fmt.Errorf("walk error: %s", err)
+		}
+		for _, ig := range ignore {
+			if strings.HasSuffix(path, ig) {
+				return nil
+			}
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+		if st.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		return copyFile(path, target)
+	})
+}
+
+// Header writes a file header: a code generation comment, the package
+// declaration, and an import block built from imports (only written if
+// imports is non-empty).
+//
+// Earlier versions hard-coded the zlib/base64 decode imports here, plus a
+// "var _, _, _, _ = ..." sink to keep them from being "imported and not
+// used" when a file turned out not to need them. Now that Pack computes
+// imports from the codecs Options.encode actually used, every import in the
+// block is guaranteed to be referenced by the generated code, so the sink
+// is no longer needed.
+//
+// If buildTags are given, a //go:build constraint (and the matching
+// // +build line, for pre-1.17 toolchains) requiring all of them is written
+// before the package declaration.
+func Header(fp io.Writer, pkg string, imports []string, buildTags ...string) error {
+	if len(buildTags) > 0 {
+		_, err := fmt.Fprintf(fp, "//go:build %s\n// +build %s\n\n",
+			strings.Join(buildTags, " && "), strings.Join(buildTags, ","))
+		if err != nil {
+			return err
+		}
+	}
+
 	_, err := fp.Write([]byte("// Code generated by pack.go; DO NOT EDIT.\n\n"))
 	if err != nil {
 		return err
 	}
+	_, err = fmt.Fprintf(fp, "package %s\n\n", pkg)
+	if err != nil {
+		return err
+	}
+	if len(imports) == 0 {
+		return nil
+	}
+
+	sorted := append([]string(nil), imports...)
+	sort.Strings(sorted)
+
+	_, err = fp.Write([]byte("import (\n"))
+	if err != nil {
+		return err
+	}
+	for _, imp := range sorted {
+		_, err = fmt.Fprintf(fp, "\t%q\n", imp)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fp.Write([]byte(")\n\n"))
+	return err
+}
+
+// HeaderDev writes the file header for the pack_dev.go mirror that devFile
+// and devDir produce.
+func HeaderDev(fp io.Writer, pkg string) error {
+	_, err := fp.Write([]byte("//go:build dev\n// +build dev\n\n"))
+	if err != nil {
+		return err
+	}
+	_, err = fp.Write([]byte("// Code generated by pack.go; DO NOT EDIT.\n\n"))
+	if err != nil {
+		return err
+	}
 	_, err = fp.Write([]byte("package " + pkg + "\n\nimport (" + `
-		"bytes"
-		"compress/zlib"
-		"encoding/base64"
 		"io/ioutil"
-	` + ")\n\nvar _, _, _, _ = zlib.BestSpeed, base64.NoPadding, ioutil.Discard, bytes.Join\n\n"))
+		"os"
+		"path/filepath"
+	` + ")\n\nvar _, _, _ = ioutil.Discard, os.Stdin, filepath.Separator\n\n"))
+	return err
+}
+
+// devFile writes a single file as a variable that's read from path on disk
+// once, when the package is initialized, instead of being embedded in the
+// binary. It's the -tags dev counterpart to File.
+func devFile(fp io.Writer, varname, path string) error {
+	_, err := fmt.Fprintf(fp, `var %s = func() []byte {
+		d, err := ioutil.ReadFile(%q)
+		if err != nil {
+			panic(err)
+		}
+		return d
+	}()
+`, varname, path)
 	return err
 }
 
-// File writes a single file as a variable.
+// devDir writes a map[string][]byte that's built from dir on disk once, when
+// the package is initialized, instead of being embedded in the binary. It's
+// the -tags dev counterpart to Dir: map keys are name (the slash-separated
+// name Dir's map keys start with) joined with each file's path relative to
+// dir. Ignore patterns are not applied.
+func devDir(fp io.Writer, varname, dir, name string) error {
+	_, err := fmt.Fprintf(fp, `var %s = func() map[string][]byte {
+		m := make(map[string][]byte)
+		err := filepath.Walk(%q, func(path string, st os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if st.IsDir() {
+				return nil
+			}
+			d, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(%[2]q, path)
+			if err != nil {
+				return err
+			}
+			m[filepath.ToSlash(filepath.Join(%[3]q, rel))] = d
+			return nil
+		})
+		if err != nil {
+			panic(err)
+		}
+		return m
+	}()
+`, varname, dir, name)
+	return err
+}
+
+// File writes a single file as a variable, using the default codec policy
+// (valid, NUL-free UTF-8 text as a literal; other data zlib-compressed above
+// 100K, raw base64 otherwise) and
+// reading from the current working directory (or an absolute path).
+//
+// Use FileOpts to read from an fs.FS or to choose codecs.
 func File(fp io.Writer, varname, path string) error {
-	d, err := ioutil.ReadFile(path)
+	return FileOpts(fp, varname, path, Options{})
+}
+
+// FileOpts is like File, but lets the caller read from opts.FS and control
+// codec selection via opts.
+func FileOpts(fp io.Writer, varname, path string, opts Options) error {
+	fsys, name := opts.fsys(path)
+	d, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return err
+	}
+
+	enc, err := opts.encode(path, d)
 	if err != nil {
 		return err
 	}
 
-	_, err = fmt.Fprintf(fp, "var %s = %s\n", varname, enc(d))
+	_, err = fmt.Fprintf(fp, "var %s = %s\n", varname, enc)
 	return err
 }
 
-// Dir recursively writes all files in a directory as variables.
+// Dir recursively writes all files in a directory as variables, using the
+// default codec policy and reading from the current working directory (or
+// an absolute path).
 //
-// The ignore patterns are matched by strings.HasSuffix().
+// The ignore patterns are matched by strings.HasSuffix(). Use DirOpts to
+// read from an fs.FS or to choose codecs.
 func Dir(fp io.Writer, varname, dir string, ignore ...string) error {
-	_, err := fp.Write([]byte("var " + varname + " = map[string][]byte{\n"))
+	return DirOpts(fp, varname, dir, Options{Ignore: ignore})
+}
+
+// DirOpts is like Dir, but lets the caller read from opts.FS and control
+// codec selection via opts; opts.Ignore takes the place of Dir's variadic
+// ignore patterns.
+//
+// Map keys are the walked paths as fs.WalkDir reports them: relative to
+// opts.FS (or the current working directory/filesystem root, when opts.FS
+// is nil), without a leading "./".
+func DirOpts(fp io.Writer, varname, dir string, opts Options) error {
+	fsys, name := opts.fsys(dir)
+
+	type file struct {
+		path string
+		data []byte
+	}
+	var files []file
+	err := fs.WalkDir(fsys, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return fmt.Errorf("walk error: %s", err)
+		}
+		if d.IsDir() {
+			return nil
+		}
+		for _, ig := range opts.Ignore {
+			// Special case to exclude VCS "keep" files.
+			if strings.HasSuffix(p, ig) {
+				return nil
+			}
+		}
+
+		data, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return fmt.Errorf("fs.ReadFile(%q): %s", p, err)
+		}
+		files = append(files, file{p, data})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// De-duplicate identical contents: every distinct sha256 digest is
+	// emitted once as its own blobN variable, and the map below references
+	// it by name for every path that shares it, instead of repeating a
+	// (possibly large) encoded payload per path. This also means a shared
+	// blob is only ever decoded once, since it's decoded by the blob var's
+	// initializer, not by each map entry that references it — no sync.Once
+	// needed.
+	blobOf := make([]string, len(files))
+	blobData := map[string][]byte{}
+	var blobOrder []string
+	seen := map[[sha256.Size]byte]string{}
+	for i, f := range files {
+		digest := sha256.Sum256(f.data)
+		name, ok := seen[digest]
+		if !ok {
+			name = fmt.Sprintf("%sBlob%d", fsPrefix(varname), len(seen))
+			seen[digest] = name
+			blobData[name] = f.data
+			blobOrder = append(blobOrder, name)
+		}
+		blobOf[i] = name
+	}
+
+	for _, name := range blobOrder {
+		enc, err := opts.encode(name, blobData[name])
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(fp, "var %s = %s\n", name, enc)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fp.Write([]byte("var " + varname + " = map[string][]byte{\n"))
+	if err != nil {
+		return err
+	}
+	for i, f := range files {
+		_, err = fmt.Fprintf(fp, "\t%q: %s,\n", f.path, blobOf[i])
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fp.Write([]byte("}\n\n"))
+	return err
+}
+
+// HeaderFS writes a file header for output generated with DirFS; like
+// Header, but it imports what the generated io/fs.FS implementation needs
+// along with the zlib/base64 decode helpers.
+func HeaderFS(fp io.Writer, pkg string) error {
+	_, err := fp.Write([]byte("// Code generated by pack.go; DO NOT EDIT.\n\n"))
 	if err != nil {
 		return err
 	}
+	_, err = fp.Write([]byte("package " + pkg + "\n\nimport (" + `
+		"bytes"
+		"compress/zlib"
+		"encoding/base64"
+		"io"
+		"io/fs"
+		"io/ioutil"
+		"path"
+		"sort"
+		"strings"
+		"time"
+	` + ")\n\nvar _, _, _ = zlib.BestSpeed, base64.NoPadding, ioutil.Discard\n\n"))
+	return err
+}
 
-	// Make sure to walk the contents of the directory in case of a link,
-	// instead of the link itself.
+// DirFS is like Dir, but instead of a plain map[string][]byte it generates a
+// type named typename implementing io/fs.FS, fs.ReadDirFS, fs.ReadFileFS and
+// fs.StatFS backed by the packed data, so it can be handed to http.FS,
+// template.ParseFS, fs.WalkDir, etc. without writing adapter code.
+//
+// Modtime and mode are preserved from os.Stat at pack time. ReadDir returns
+// entries in sorted order.
+//
+// The ignore patterns are matched by strings.HasSuffix().
+func DirFS(fp io.Writer, typename, dir string, ignore ...string) error {
 	if !strings.HasSuffix(dir, "/") {
 		dir += "/"
 	}
 
-	err = filepath.Walk(dir, func(path string, st os.FileInfo, err error) error {
+	type entry struct {
+		path    string
+		data    []byte
+		mode    os.FileMode
+		modTime time.Time
+		isDir   bool
+	}
+	var entries []entry
+	err := filepath.Walk(dir, func(p string, st os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("walk error: %s", err)
 		}
-		if st.IsDir() {
+		rel := strings.TrimPrefix(p, dir)
+		if rel == "" {
 			return nil
 		}
 		for _, ig := range ignore {
-			// Special case to exclude VCS "keep" files.
-			if strings.HasSuffix(path, ig) {
+			if strings.HasSuffix(p, ig) {
 				return nil
 			}
 		}
 
-		d, err := ioutil.ReadFile(path)
+		if st.IsDir() {
+			entries = append(entries, entry{path: rel, mode: st.Mode(), modTime: st.ModTime(), isDir: true})
+			return nil
+		}
+
+		d, err := ioutil.ReadFile(p)
 		if err != nil {
-			return fmt.Errorf("ioutil.ReadFile(%q): %s", path, err)
+			return fmt.Errorf("ioutil.ReadFile(%q): %s", p, err)
 		}
+		entries = append(entries, entry{path: rel, data: d, mode: st.Mode(), modTime: st.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].path < entries[j].path })
+
+	pfx := fsPrefix(typename)
 
-		_, err = fmt.Fprintf(fp, "\t\"%s\": %s,\n", path, enc(d))
+	_, err = fmt.Fprintf(fp, "type %s struct{}\n\n", typename)
+	if err != nil {
 		return err
-	})
+	}
+
+	_, err = fmt.Fprintf(fp, "type %sEntry struct {\n\tdata    []byte\n\tmode    fs.FileMode\n\tmodTime time.Time\n\tisDir   bool\n}\n\n", pfx)
 	if err != nil {
 		return err
 	}
 
+	_, err = fmt.Fprintf(fp, "var %sFiles = map[string]%sEntry{\n", pfx, pfx)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.isDir {
+			_, err = fmt.Fprintf(fp, "\t%q: {mode: 0%o, modTime: time.Unix(%d, 0), isDir: true},\n", e.path, e.mode, e.modTime.Unix())
+		} else {
+			_, err = fmt.Fprintf(fp, "\t%q: {data: %s, mode: 0%o, modTime: time.Unix(%d, 0)},\n", e.path, encDefault(e.data), e.mode, e.modTime.Unix())
+		}
+		if err != nil {
+			return err
+		}
+	}
 	_, err = fp.Write([]byte("}\n\n"))
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(fp, dirFSTemplate, typename, pfx)
 	return err
 }
 
-// Format the given file with gofmt.
+// fsPrefix returns the unexported identifier prefix used for the helper
+// types and variables a DirFS call generates, so multiple DirFS calls in the
+// same output file don't collide.
+func fsPrefix(typename string) string {
+	r := []rune(typename)
+	r[0] = unicode.ToLower(r[0])
+	return "_" + string(r)
+}
+
+// dirFSTemplate is the io/fs.FS implementation emitted by DirFS. %[1]s is
+// the exported type name, %[2]s the unexported helper prefix from fsPrefix.
+const dirFSTemplate = `func (%[1]s) Open(name string) (fs.File, error) {
+	e, ok := %[2]sFiles[name]
+	if !ok {
+		if name == "." {
+			e = %[2]sEntry{mode: fs.ModeDir | 0755, isDir: true}
+		} else {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	return &%[2]sFile{name: name, %[2]sEntry: e}, nil
+}
+
+func (t %[1]s) ReadFile(name string) ([]byte, error) {
+	e, ok := %[2]sFiles[name]
+	if !ok || e.isDir {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]byte(nil), e.data...), nil
+}
+
+func (t %[1]s) Stat(name string) (fs.FileInfo, error) {
+	f, err := t.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f.(*%[2]sFile).Stat()
+}
+
+func (t %[1]s) ReadDir(name string) ([]fs.DirEntry, error) {
+	return %[2]sReadDir(name), nil
+}
+
+// %[2]sReadDir lists the direct children of name, shared by %[1]s.ReadDir
+// and %[2]sFile.ReadDir so a directory opened directly (as fs.File.ReadDir
+// requires of the fs.ReadDirFile contract) lists the same way as the
+// top-level fs.ReadDirFS method.
+func %[2]sReadDir(name string) []fs.DirEntry {
+	prefix := name
+	if prefix == "." {
+		prefix = ""
+	} else {
+		prefix += "/"
+	}
+
+	var entries []fs.DirEntry
+	seen := map[string]bool{}
+	for p, e := range %[2]sFiles {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(p, prefix)
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			rest = rest[:i]
+			var ok bool
+			e, ok = %[2]sFiles[prefix+rest]
+			if !ok {
+				e = %[2]sEntry{mode: fs.ModeDir | 0755, isDir: true}
+			}
+		}
+		if rest == "" || seen[rest] {
+			continue
+		}
+		seen[rest] = true
+		entries = append(entries, &%[2]sDirEntry{name: rest, %[2]sEntry: e})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries
+}
+
+type %[2]sFile struct {
+	name string
+	%[2]sEntry
+	r       *bytes.Reader
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (f *%[2]sFile) Stat() (fs.FileInfo, error) {
+	return &%[2]sFileInfo{f.name, f.%[2]sEntry}, nil
+}
+
+func (f *%[2]sFile) reader() *bytes.Reader {
+	if f.r == nil {
+		f.r = bytes.NewReader(f.data)
+	}
+	return f.r
+}
+
+func (f *%[2]sFile) Read(b []byte) (int, error) { return f.reader().Read(b) }
+
+// Seek lets a %[2]sFile back http.FS, whose doc requires "the files
+// provided by fsys must implement io.Seeker" for Range request support.
+func (f *%[2]sFile) Seek(offset int64, whence int) (int64, error) {
+	return f.reader().Seek(offset, whence)
+}
+
+// ReadDir satisfies the fs.ReadDirFile contract fs.File documents for
+// directories, so a %[2]sFile opened directly (rather than through
+// %[1]s.ReadDir) can still be listed, as testing/fstest.TestFS requires.
+func (f *%[2]sFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !f.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
+	}
+	if f.entries == nil {
+		f.entries = %[2]sReadDir(f.name)
+	}
+	if n <= 0 {
+		entries := f.entries[f.offset:]
+		f.offset = len(f.entries)
+		return entries, nil
+	}
+	if f.offset >= len(f.entries) {
+		return nil, io.EOF
+	}
+	end := f.offset + n
+	if end > len(f.entries) {
+		end = len(f.entries)
+	}
+	entries := f.entries[f.offset:end]
+	f.offset = end
+	return entries, nil
+}
+
+func (f *%[2]sFile) Close() error { return nil }
+
+type %[2]sFileInfo struct {
+	name string
+	%[2]sEntry
+}
+
+func (fi *%[2]sFileInfo) Name() string      { return path.Base(fi.name) }
+func (fi *%[2]sFileInfo) Size() int64       { return int64(len(fi.data)) }
+func (fi *%[2]sFileInfo) Mode() fs.FileMode { return fi.mode }
+func (fi *%[2]sFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *%[2]sFileInfo) IsDir() bool       { return fi.isDir }
+func (fi *%[2]sFileInfo) Sys() interface{}  { return nil }
+
+type %[2]sDirEntry struct {
+	name string
+	%[2]sEntry
+}
+
+func (de *%[2]sDirEntry) Name() string      { return de.name }
+func (de *%[2]sDirEntry) IsDir() bool       { return de.isDir }
+func (de *%[2]sDirEntry) Type() fs.FileMode { return de.mode.Type() }
+func (de *%[2]sDirEntry) Info() (fs.FileInfo, error) {
+	return &%[2]sFileInfo{de.name, de.%[2]sEntry}, nil
+}
+
+`
+
+// Format formats the Go source file at path in place.
+//
+// It's a thin wrapper over go/format.Source kept for backwards
+// compatibility; earlier versions shelled out to the gofmt binary, which
+// meant Format (and Pack) required gofmt to be on $PATH and could leave a
+// truncated file behind if gofmt failed partway through.
 func Format(path string) error {
-	// TODO: can also use "go/format.Source(data)"
-	out, err := exec.Command("gofmt", "-w", path).CombinedOutput()
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return writeFormatted(path, src)
+}
+
+// writeFormatted formats src with go/format.Source and atomically writes
+// the result to path. If formatting or writing fails, any existing file at
+// path is left untouched.
+func writeFormatted(path string, src []byte) error {
+	out, err := format.Source(src)
 	if err != nil {
-		return fmt.Errorf("gofmt: %s: %s", err, string(out))
+		return fmt.Errorf("format.Source: %s", err)
 	}
-	return nil
+	return atomicWrite(path, out)
+}
+
+// syncWriteCloser is the subset of *os.File atomicWrite needs. It exists so
+// tests can substitute a fault-injecting implementation to exercise a
+// failure partway through fp.Write or fp.Sync directly, rather than relying
+// on OS-level tricks (e.g. a read-only directory) that can't reach those
+// calls and don't behave consistently across environments (a read-only
+// directory doesn't stop root from creating files in it).
+type syncWriteCloser interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// createTemp is overridden in tests.
+var createTemp = func(name string) (syncWriteCloser, error) { return os.Create(name) }
+
+// atomicWrite writes data to path atomically: it's written to a temporary
+// file next to path, synced, and then renamed over path. path is only ever
+// touched by the final rename, so a failure at any earlier step leaves an
+// existing file at path untouched.
+func atomicWrite(path string, data []byte) error {
+	tmp := path + ".tmp"
+	fp, err := createTemp(tmp)
+	if err != nil {
+		return err
+	}
+
+	_, err = fp.Write(data)
+	if err != nil {
+		fp.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	err = fp.Sync()
+	if err != nil {
+		fp.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	err = fp.Close()
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
 }
 
 // Varname replaces any sequence of invalid identifier characters with an _.
@@ -199,43 +955,315 @@ func Varname(s string) string {
 	return string(n)
 }
 
-func enc(s []byte) string {
-	if bytes.IndexByte(s, 0) == -1 && utf8.Valid(s) {
-		return fmt.Sprintf("[]byte(`%s`)", bytes.Replace(s, []byte("`"), []byte("` + \"`\" + `"), -1))
+// Codec is a pluggable compression scheme for the binary payloads (data that
+// isn't valid, NUL-free UTF-8 text) that File/Dir/Pack would otherwise store
+// as raw base64; text is always stored as a literal. Implementations
+// should be stateless and safe to reuse across calls.
+type Codec interface {
+	// Name identifies the codec, used in error messages and to de-duplicate
+	// codecs across a single generated file.
+	Name() string
+
+	// Encode compresses data into the wire format RuntimeSnippet decodes.
+	Encode(data []byte) ([]byte, error)
+
+	// RuntimeSnippet returns Go statements that decode the payload held in
+	// the local variable z ([]byte, the base64-decoded Encode output) and
+	// end by returning the decoded []byte (CodecRaw's is just "return z").
+	// The statements
+	// run inside a `func() []byte { ... }()` closure that already has z and
+	// an in-scope `err error`.
+	RuntimeSnippet() string
+
+	// Imports lists the import paths RuntimeSnippet's statements need.
+	Imports() []string
+}
+
+// CodecZlib compresses with compress/zlib. It's zpack's original codec, and
+// the default for Options.
+type CodecZlib struct{}
+
+func (CodecZlib) Name() string { return "zlib" }
+
+func (CodecZlib) Encode(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := zlib.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
 	}
+	return b.Bytes(), nil
+}
 
-	// Compress files larger than 100K
-	if len(s) > 1024*100 {
-		var b bytes.Buffer
-		w := zlib.NewWriter(&b)
-		w.Write(s)
-		w.Close()
+func (CodecZlib) RuntimeSnippet() string {
+	return `r, err := zlib.NewReader(bytes.NewReader(z))
+		if err != nil {
+			panic(err)
+		}
+		s, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		r.Close()
+		return s`
+}
 
-		return fmt.Sprintf(`func() []byte {
-			z, err := base64.StdEncoding.DecodeString("%s")
-			if err != nil {
-				panic(err)
-			}
-			r, err := zlib.NewReader(bytes.NewReader(z))
-			if err != nil {
-				panic(err)
-			}
+func (CodecZlib) Imports() []string { return []string{"bytes", "compress/zlib", "io/ioutil"} }
 
-			s, err := ioutil.ReadAll(r)
-			if err != nil {
-				panic(err)
-			}
-			r.Close()
-			return s
-		}()`, base64.StdEncoding.EncodeToString(b.Bytes()))
+// CodecGzip compresses with compress/gzip.
+type CodecGzip struct{}
+
+func (CodecGzip) Name() string { return "gzip" }
+
+func (CodecGzip) Encode(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (CodecGzip) RuntimeSnippet() string {
+	return `r, err := gzip.NewReader(bytes.NewReader(z))
+		if err != nil {
+			panic(err)
+		}
+		s, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		r.Close()
+		return s`
+}
+
+func (CodecGzip) Imports() []string { return []string{"bytes", "compress/gzip", "io/ioutil"} }
+
+// CodecFlate compresses with compress/flate, the raw DEFLATE stream zlib and
+// gzip both wrap. It has no header/checksum overhead, which can matter for
+// many small payloads.
+type CodecFlate struct{}
+
+func (CodecFlate) Name() string { return "flate" }
+
+func (CodecFlate) Encode(data []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (CodecFlate) RuntimeSnippet() string {
+	return `r := flate.NewReader(bytes.NewReader(z))
+		s, err := ioutil.ReadAll(r)
+		if err != nil {
+			panic(err)
+		}
+		r.Close()
+		return s`
+}
+
+func (CodecFlate) Imports() []string { return []string{"bytes", "compress/flate", "io/ioutil"} }
+
+// CodecRaw stores data as plain base64, without any compression. It's what
+// Options uses for payloads its selection policy doesn't want compressed.
+//
+// Other codecs, such as zstd (eg. via github.com/klauspost/compress/zstd),
+// can be added by implementing the Codec interface; zpack only depends on
+// the standard library, so they aren't built in.
+type CodecRaw struct{}
+
+func (CodecRaw) Name() string                       { return "raw" }
+func (CodecRaw) Encode(data []byte) ([]byte, error) { return data, nil }
+func (CodecRaw) RuntimeSnippet() string             { return "return z" }
+func (CodecRaw) Imports() []string                  { return nil }
+
+// Options configures how PackOpts, DirOpts, and FileOpts encode file
+// contents.
+//
+// The zero value reproduces zpack's original behaviour: valid, NUL-free
+// UTF-8 text is stored as a Go literal whatever its size; other payloads
+// over 100K are zlib-compressed, and the rest are stored as raw base64.
+type Options struct {
+	// FS is the filesystem FileOpts/DirOpts/PackOpts read from. It can be a live
+	// directory (os.DirFS), an embed.FS, a zip.Reader wrapped as an fs.FS,
+	// a txtar archive wrapped as an fs.FS, or anything else implementing
+	// fs.FS; this lets release artifacts be packed straight out of a module
+	// zip or a generated bundle without first unpacking them to disk.
+	//
+	// Paths passed to FileOpts/DirOpts/PackOpts are cleaned with path.Clean
+	// and then used as names within FS, so once cleaned they must satisfy
+	// fs.ValidPath: no leading "/" and no "..", "." for the FS root.
+	//
+	// If nil, paths are resolved against the current working directory (or
+	// treated as absolute disk paths), matching zpack's original behaviour.
+	FS fs.FS
+
+	// Codecs are the codecs available to the default selection policy, in
+	// preference order; the first one is used for any non-text payload over
+	// 100K.
+	// Select, if set, isn't limited to this list. Defaults to
+	// []Codec{CodecZlib{}}.
+	Codecs []Codec
+
+	// Select picks the codec used to encode a given file's contents; it's
+	// only called for contents that aren't valid, NUL-free UTF-8 text. It may
+	// return nil, meaning: store the data as raw (uncompressed) base64. If
+	// Select is nil, the default policy described above is used.
+	Select func(path string, data []byte) Codec
+
+	// Ignore patterns are matched against walked paths with
+	// strings.HasSuffix(); matching paths are skipped. Only used by
+	// DirOpts/PackOpts.
+	Ignore []string
+
+	// Dev, if true, makes PackOpts additionally write a "_dev.go" mirror
+	// next to each output file (see HeaderDev) that reads the packed paths
+	// from disk when the package is initialized instead of from the packed
+	// payload, for
+	// fast edit/reload cycles under "go build -tags dev". Only used by
+	// PackOpts, and only takes effect when FS is nil, since the mirror
+	// re-reads from the original on-disk paths.
+	Dev bool
+
+	used map[string]Codec
+}
+
+// fsys resolves p against o.FS, returning the fs.FS to read from and p's
+// name within it. If o.FS is nil, p is resolved against the current working
+// directory (relative paths) or the root of the filesystem (absolute
+// paths), reproducing the plain os.Stat/ioutil.ReadFile/filepath.Walk
+// behaviour File/Dir/Pack used before they were rewritten on top of fs.FS.
+//
+// The o.FS == nil case deliberately uses osFS rather than os.DirFS: os.DirFS
+// rejects names that escape its root (e.g. "../outside.txt") per
+// fs.ValidPath, which would break existing callers passing such paths to
+// File/Dir/Pack.
+func (o Options) fsys(p string) (fs.FS, string) {
+	if o.FS != nil {
+		return o.FS, path.Clean(p)
+	}
+	if filepath.IsAbs(p) {
+		return osFS("/"), path.Clean(strings.TrimPrefix(filepath.ToSlash(p), "/"))
+	}
+	return osFS("."), path.Clean(filepath.ToSlash(p))
+}
+
+// osFS is like os.DirFS, except it does not enforce fs.ValidPath on the
+// names passed to Open: a name containing ".." that escapes dir is resolved
+// rather than rejected. This preserves the behaviour of the os.Stat/
+// ioutil.ReadFile-based code File/Dir/Pack used before they were rewritten
+// on top of fs.FS, for the common case where no Options.FS is given.
+type osFS string
+
+func (dir osFS) Open(name string) (fs.File, error) {
+	return os.Open(filepath.Join(string(dir), filepath.FromSlash(name)))
+}
+
+// codec runs the selection policy for path/data, recording the result so
+// imports() can later compute the import block it needs.
+func (o *Options) codec(path string, data []byte) Codec {
+	sel := o.Select
+	if sel == nil {
+		sel = o.defaultSelect
+	}
+
+	c := sel(path, data)
+	if c == nil {
+		c = CodecRaw{}
+	}
+	if o.used != nil {
+		o.used[c.Name()] = c
+	}
+	return c
+}
+
+func (o *Options) defaultSelect(_ string, data []byte) Codec {
+	if len(data) <= 1024*100 {
+		return nil
+	}
+	if len(o.Codecs) == 0 {
+		return CodecZlib{}
+	}
+	return o.Codecs[0]
+}
+
+// encode renders data as a Go expression: a literal for valid, NUL-free
+// UTF-8 text, or a func() []byte {...} closure decoding a Codec-encoded
+// payload otherwise.
+func (o *Options) encode(path string, data []byte) (string, error) {
+	if bytes.IndexByte(data, 0) == -1 && utf8.Valid(data) {
+		return fmt.Sprintf("[]byte(`%s`)", bytes.Replace(data, []byte("`"), []byte("` + \"`\" + `"), -1)), nil
+	}
+
+	c := o.codec(path, data)
+	enc, err := c.Encode(data)
+	if err != nil {
+		return "", fmt.Errorf("%s.Encode: %s", c.Name(), err)
 	}
 
-	// TODO: maybe wrap?
 	return fmt.Sprintf(`func() []byte {
-		s, err := base64.StdEncoding.DecodeString("%s")
+		z, err := base64.StdEncoding.DecodeString(%q)
 		if err != nil {
 			panic(err)
 		}
-		return s
-	}()`, base64.StdEncoding.EncodeToString(s))
+		%s
+	}()`, base64.StdEncoding.EncodeToString(enc), c.RuntimeSnippet()), nil
+}
+
+// imports returns the sorted set of import paths needed by the codecs used
+// so far (plus "encoding/base64", needed by any of them), or nil if nothing
+// but literals were encoded.
+func (o *Options) imports() []string {
+	if len(o.used) == 0 {
+		return nil
+	}
+
+	set := map[string]bool{"encoding/base64": true}
+	for _, c := range o.used {
+		for _, imp := range c.Imports() {
+			set[imp] = true
+		}
+	}
+
+	imports := make([]string, 0, len(set))
+	for imp := range set {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	return imports
+}
+
+// encDefault renders data with the default codec policy (text as a literal;
+// other data zlib above 100K, otherwise raw base64), for callers that
+// pre-date Options,
+// such as DirFS.
+func encDefault(data []byte) string {
+	var o Options
+	s, err := o.encode("", data)
+	if err != nil {
+		// CodecZlib.Encode only fails if the underlying io.Writer errors,
+		// which bytes.Buffer never does.
+		panic(err)
+	}
+	return s
 }
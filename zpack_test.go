@@ -1,11 +1,19 @@
 package zpack
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/fstest"
 )
 
 func TestPack(t *testing.T) {
@@ -40,6 +48,420 @@ func TestPack(t *testing.T) {
 	// if err != nil {
 	// 	t.Fatalf("go test: %s: %s", err, out)
 	// }
+
+	if _, err := os.Stat(tmp + "/pack_dev.go"); !os.IsNotExist(err) {
+		t.Errorf("Pack must not write a _dev.go mirror unless Options.Dev is set, got err: %v", err)
+	}
+}
+
+func TestPackOptsDev(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpackoptsdev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	err = PackOpts(map[string]map[string]string{
+		tmp + "/pack.go": map[string]string{
+			"zpack": "./zpack.go",
+		},
+	}, Options{Dev: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tmp + "/pack_dev.go"); err != nil {
+		t.Errorf("expected a pack_dev.go mirror when Options.Dev is true: %s", err)
+	}
+}
+
+func TestPackEmbed(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpackembed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	err = PackEmbed(map[string]map[string]string{
+		tmp + "/pack.go": map[string]string{
+			"zpack": "./zpack.go",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(tmp + "/pack.embed/zpack/zpack.go")
+	if err != nil {
+		t.Fatalf("staged file not found: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(tmp + "/pack.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No embed.FS variable is emitted for a lone []byte entry, so "embed"
+	// must be blank-imported or the generated file fails to build with
+	// "embed" imported and not used.
+	if !strings.Contains(string(got), `_ "embed"`) {
+		t.Errorf("expected a blank import of \"embed\", got:\n%s", got)
+	}
+}
+
+func TestPackEmbedDir(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpackembeddir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	err = PackEmbed(map[string]map[string]string{
+		tmp + "/pack.go": map[string]string{
+			"zpackDir": ".",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(tmp + "/pack.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An embed.FS entry is named as a type, so "embed" must be imported
+	// by name rather than blank-imported.
+	if !strings.Contains(string(got), `"embed"`) || strings.Contains(string(got), `_ "embed"`) {
+		t.Errorf("expected a named import of \"embed\", got:\n%s", got)
+	}
+}
+
+func TestPackEmbedBasenameCollision(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testpackembedcollision")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	for _, d := range []string{"srcA", "srcB"} {
+		if err := os.Mkdir(tmp+"/"+d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(tmp+"/srcA/data.txt", []byte("from A"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(tmp+"/srcB/data.txt", []byte("from B"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = PackEmbed(map[string]map[string]string{
+		tmp + "/out/pack.go": map[string]string{
+			"DataA": tmp + "/srcA/data.txt",
+			"DataB": tmp + "/srcB/data.txt",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotA, err := ioutil.ReadFile(tmp + "/out/pack.embed/DataA/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotB, err := ioutil.ReadFile(tmp + "/out/pack.embed/DataB/data.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(gotA) != "from A" {
+		t.Errorf("DataA: got %q, want %q", gotA, "from A")
+	}
+	if string(gotB) != "from B" {
+		t.Errorf("DataB: got %q, want %q", gotB, "from B")
+	}
+}
+
+func TestDirFS(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testdirfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	out, err := os.Create(tmp + "/pack.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { out.Close() }()
+
+	err = HeaderFS(out, "testdirfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = DirFS(out, "Assets", ".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Format(tmp + "/pack.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := ioutil.ReadFile(tmp + "/pack.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// http.FS requires fsys's files to implement io.Seeker for Range
+	// request support, and fs.File documents that a directory's ReadDir
+	// must work even when opened directly rather than via fs.ReadDirFS.
+	for _, want := range []string{"func (f *_assetsFile) Seek(", "func (f *_assetsFile) ReadDir("} {
+		if !strings.Contains(string(got), want) {
+			t.Errorf("expected generated output to contain %q", want)
+		}
+	}
+}
+
+// failingWriteCloser is a syncWriteCloser whose Write always fails, used to
+// simulate a failure partway through atomicWrite's write to its temporary
+// file without relying on OS-level tricks like a read-only directory, which
+// don't stop root from writing and never actually reach fp.Write anyway.
+type failingWriteCloser struct{}
+
+func (failingWriteCloser) Write([]byte) (int, error) { return 0, errors.New("simulated write failure") }
+func (failingWriteCloser) Sync() error               { return nil }
+func (failingWriteCloser) Close() error              { return nil }
+
+func TestFormatPreservesFileOnWriteFailure(t *testing.T) {
+	orig := createTemp
+	createTemp = func(string) (syncWriteCloser, error) { return failingWriteCloser{}, nil }
+	defer func() { createTemp = orig }()
+
+	tmp, err := ioutil.TempDir("", "testformat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	path := tmp + "/pack.go"
+	want := []byte("package x\n\nvar A = 1\n")
+	err = ioutil.WriteFile(path, want, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Format(path)
+	if err == nil {
+		t.Fatal("expected an error from the injected write failure, got nil")
+	}
+
+	got, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("file was modified:\ngot:  %s\nwant: %s", got, want)
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog. "), 5000)
+
+	tests := []struct {
+		name  string
+		codec Codec
+		read  func([]byte) (io.Reader, error)
+	}{
+		{"zlib", CodecZlib{}, func(b []byte) (io.Reader, error) { return zlib.NewReader(bytes.NewReader(b)) }},
+		{"gzip", CodecGzip{}, func(b []byte) (io.Reader, error) { return gzip.NewReader(bytes.NewReader(b)) }},
+		{"flate", CodecFlate{}, func(b []byte) (io.Reader, error) { return flate.NewReader(bytes.NewReader(b)), nil }},
+		{"raw", CodecRaw{}, func(b []byte) (io.Reader, error) { return bytes.NewReader(b), nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc, err := tt.codec.Encode(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := tt.read(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("%s roundtrip: got %d bytes, want %d", tt.name, len(got), len(data))
+			}
+		})
+	}
+}
+
+func TestOptionsImports(t *testing.T) {
+	o := Options{used: map[string]Codec{}}
+	_, err := o.encode("big.bin", bytes.Repeat([]byte{0xff}, 1024*101))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := fmt.Sprint(o.imports())
+	want := fmt.Sprint([]string{"bytes", "compress/zlib", "encoding/base64", "io/ioutil"})
+	if got != want {
+		t.Errorf("imports = %s, want %s", got, want)
+	}
+}
+
+func TestOptionsSelect(t *testing.T) {
+	var calls []string
+	o := Options{
+		used: map[string]Codec{},
+		Select: func(path string, data []byte) Codec {
+			calls = append(calls, path)
+			return CodecGzip{}
+		},
+	}
+
+	out, err := o.encode("binary.dat", []byte{0x00, 0x01, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || calls[0] != "binary.dat" {
+		t.Errorf("Select called with %v, want one call for binary.dat", calls)
+	}
+	if _, ok := o.used["gzip"]; !ok {
+		t.Errorf("expected gzip to be recorded as used, got %v", o.used)
+	}
+	if !bytes.Contains([]byte(out), []byte("gzip.NewReader")) {
+		t.Errorf("expected output to decode with gzip, got: %s", out)
+	}
+}
+
+func TestFileOptsFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"greeting.txt": &fstest.MapFile{Data: []byte("hello from an fs.FS\n")},
+	}
+
+	var buf bytes.Buffer
+	err := FileOpts(&buf, "Greeting", "greeting.txt", Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "hello from an fs.FS") {
+		t.Errorf("expected packed output to contain the file contents, got: %s", buf.String())
+	}
+}
+
+func TestFileOptsEscapingPath(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "testescapingpath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.RemoveAll(tmp) }()
+
+	err = ioutil.WriteFile(tmp+"/outside.txt", []byte("outside the package dir"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := tmp + "/sub"
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { os.Chdir(wd) }()
+	if err := os.Chdir(sub); err != nil {
+		t.Fatal(err)
+	}
+
+	// No Options.FS given: FileOpts must fall back to plain os-based path
+	// resolution, same as before the fs.FS rework, so ".."-relative paths
+	// keep working rather than being rejected by fs.ValidPath.
+	var buf bytes.Buffer
+	err = FileOpts(&buf, "Outside", "../outside.txt", Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "outside the package dir") {
+		t.Errorf("expected packed output to contain the file contents, got: %s", buf.String())
+	}
+}
+
+func TestDirOptsFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"a.txt":     &fstest.MapFile{Data: []byte("a")},
+		"sub/b.txt": &fstest.MapFile{Data: []byte("b")},
+	}
+
+	var buf bytes.Buffer
+	err := DirOpts(&buf, "Assets", ".", Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{`"a.txt"`, `"sub/b.txt"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected map key %s in output:\n%s", want, out)
+		}
+	}
+}
+
+func TestDirOptsDedup(t *testing.T) {
+	dup := bytes.Repeat([]byte("duplicate payload\n"), 100)
+	fsys := fstest.MapFS{
+		"a.png":      &fstest.MapFile{Data: dup},
+		"b.png":      &fstest.MapFile{Data: dup},
+		"c/d.png":    &fstest.MapFile{Data: dup},
+		"unique.txt": &fstest.MapFile{Data: []byte("not a duplicate")},
+	}
+
+	var buf bytes.Buffer
+	err := DirOpts(&buf, "Assets", ".", Options{FS: fsys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	if n := strings.Count(out, "var _assetsBlob0 ="); n != 1 {
+		t.Errorf("expected the shared blob to be emitted exactly once, got %d", n)
+	}
+	if n := strings.Count(out, "_assetsBlob0"); n != 4 { // 1 var decl + 3 map references
+		t.Errorf("expected _assetsBlob0 to be referenced by all 3 duplicate paths, got %d occurrences", n)
+	}
+	if !strings.Contains(out, "var _assetsBlob1 =") {
+		t.Error("expected a second blob for unique.txt")
+	}
+}
+
+// BenchmarkDirOptsDedup packs 50 files with identical contents and reports
+// the generated source size, which deduplication keeps to one encoded copy
+// of the payload plus one map entry per path.
+func BenchmarkDirOptsDedup(b *testing.B) {
+	dup := bytes.Repeat([]byte("duplicate payload "), 2000)
+	fsys := fstest.MapFS{}
+	for i := 0; i < 50; i++ {
+		fsys[fmt.Sprintf("file%d.bin", i)] = &fstest.MapFile{Data: dup}
+	}
+
+	var size int
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		if err := DirOpts(&buf, "Assets", ".", Options{FS: fsys}); err != nil {
+			b.Fatal(err)
+		}
+		size = buf.Len()
+	}
+	b.ReportMetric(float64(size), "generated-bytes")
 }
 
 func TestVaraname(t *testing.T) {